@@ -12,22 +12,132 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/kata-containers/runtime/pkg/katautils/hooks"
 	"github.com/kata-containers/runtime/virtcontainers/pkg/oci"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opentracing/opentracing-go/log"
 	"github.com/sirupsen/logrus"
 )
 
+// preCreateHooksAnnotation declares the pre-create hooks to run for a
+// container. Its value is a JSON-encoded list of PreCreateHook. Pre-create
+// hooks are a Kata extension: they run before the runtime spec is
+// committed to the sandbox, which is earlier than anything the OCI
+// runtime-spec hook stages can express, so there is no standard spec
+// field to carry them.
+const preCreateHooksAnnotation = "io.katacontainers.pkg.oci.hooks.precreate"
+
 // Logger returns a logrus logger appropriate for logging hook messages
 func hookLogger() *logrus.Entry {
 	return kataUtilsLogger.WithField("subsystem", "hook")
 }
 
-func runHook(ctx context.Context, hook specs.Hook, cid, bundlePath string) error {
+var (
+	hookManagerMutex sync.RWMutex
+	hookManager      *hooks.Manager
+)
+
+// SetHookManager configures the drop-in hook manager used to augment the
+// hooks declared in the OCI spec for every subsequent PreCreateHooks,
+// PreStartHooks, PostStartHooks, and PostStopHooks call. Pass nil to stop
+// using drop-in hooks.
+func SetHookManager(m *hooks.Manager) {
+	hookManagerMutex.Lock()
+	defer hookManagerMutex.Unlock()
+
+	hookManager = m
+}
+
+// inlineHooks returns the hooks the bundle's own OCI spec declares for
+// stage, or nil if the spec has no "hooks" at all.
+func inlineHooks(spec oci.CompatOCISpec, stage string) []specs.Hook {
+	if spec.Hooks == nil {
+		return nil
+	}
+
+	switch stage {
+	case "prestart":
+		return spec.Hooks.Prestart
+	case "poststart":
+		return spec.Hooks.Poststart
+	case "poststop":
+		return spec.Hooks.Poststop
+	default:
+		return nil
+	}
+}
+
+// mergedHooks returns inline (from the OCI spec) and drop-in (from the
+// configured hook manager, if any) hooks for stage, in that order: hooks
+// from the bundle's own config run before host-configured drop-ins.
+func mergedHooks(spec oci.CompatOCISpec, stage string, inline []specs.Hook) []specs.Hook {
+	hookManagerMutex.RLock()
+	m := hookManager
+	hookManagerMutex.RUnlock()
+
+	if m == nil {
+		return inline
+	}
+
+	discovered, err := m.Hooks(spec, hasBindMounts(spec))
+	if err != nil {
+		hookLogger().WithError(err).Warn("failed to resolve drop-in hooks")
+		return inline
+	}
+
+	if len(discovered[stage]) == 0 {
+		return inline
+	}
+
+	return append(append([]specs.Hook{}, inline...), discovered[stage]...)
+}
+
+// dropInPreCreateHooks returns the configured hook manager's "precreate"
+// hooks for spec, already filtered by their own When selector, so they
+// always run from PreCreateHooks' point of view.
+func dropInPreCreateHooks(spec oci.CompatOCISpec, hasBindMounts bool) []PreCreateHook {
+	hookManagerMutex.RLock()
+	m := hookManager
+	hookManagerMutex.RUnlock()
+
+	if m == nil {
+		return nil
+	}
+
+	discovered, err := m.Hooks(spec, hasBindMounts)
+	if err != nil {
+		hookLogger().WithError(err).Warn("failed to resolve drop-in pre-create hooks")
+		return nil
+	}
+
+	preCreate := make([]PreCreateHook, 0, len(discovered["precreate"]))
+	for _, h := range discovered["precreate"] {
+		preCreate = append(preCreate, PreCreateHook{Hook: h, When: PreCreateHookWhen{Always: true}})
+	}
+
+	return preCreate
+}
+
+// newHookState builds the specs.State delivered to a hook on stdin. pid is
+// the container's actual init PID as reported by the sandbox/agent, or 0
+// if the container does not exist yet (e.g. prestart), per the OCI spec.
+func newHookState(cid, bundlePath, status string, pid int, annotations map[string]string) specs.State {
+	return specs.State{
+		Pid:         pid,
+		Bundle:      bundlePath,
+		ID:          cid,
+		Status:      status,
+		Annotations: annotations,
+	}
+}
+
+func runHook(ctx context.Context, hook specs.Hook, state specs.State) error {
 	span, _ := Trace(ctx, "hook")
 	defer span.Finish()
 
@@ -37,12 +147,6 @@ func runHook(ctx context.Context, hook specs.Hook, cid, bundlePath string) error
 		log.String("hook-name", hook.Path),
 		log.String("hook-args", strings.Join(hook.Args, " ")))
 
-	state := specs.State{
-		Pid:    syscall.Gettid(),
-		Bundle: bundlePath,
-		ID:     cid,
-	}
-
 	stateJSON, err := json.Marshal(state)
 	if err != nil {
 		return err
@@ -62,80 +166,371 @@ func runHook(ctx context.Context, hook specs.Hook, cid, bundlePath string) error
 		return err
 	}
 
-	if hook.Timeout == nil {
-		if err := cmd.Wait(); err != nil {
-			return fmt.Errorf("%s: stdout: %s, stderr: %s", err, stdout.String(), stderr.String())
-		}
-	} else {
-		done := make(chan error, 1)
-		go func() {
-			done <- cmd.Wait()
-			close(done)
-		}()
-
-		select {
-		case err := <-done:
-			if err != nil {
-				return fmt.Errorf("%s: stdout: %s, stderr: %s", err, stdout.String(), stderr.String())
-			}
-		case <-time.After(time.Duration(*hook.Timeout) * time.Second):
-			if err := syscall.Kill(cmd.Process.Pid, syscall.SIGKILL); err != nil {
-				return err
-			}
+	if err := waitHook(ctx, cmd, hook.Timeout); err != nil {
+		return fmt.Errorf("%s: stdout: %s, stderr: %s", err, stdout.String(), stderr.String())
+	}
 
-			return fmt.Errorf("Hook timeout")
+	return nil
+}
+
+// postKillTimeout is how long waitHook waits, after sending SIGTERM to a
+// hook that has timed out or whose context was cancelled, before
+// escalating to SIGKILL. It is a package-level var so operators embedding
+// katautils can tune it.
+var postKillTimeout = 10 * time.Second
+
+// waitHook waits for cmd to exit. It is bounded by whichever comes first
+// of ctx and hook's own Timeout (seconds; nil means no bound of its
+// own). On timeout or ctx cancellation it sends SIGTERM, gives the
+// process postKillTimeout to exit, then escalates to SIGKILL. It always
+// waits for the process to be reaped before returning, so no goroutine
+// or zombie is leaked.
+func waitHook(ctx context.Context, cmd *exec.Cmd, timeout *int) error {
+	if timeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*timeout)*time.Second)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+		close(done)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return killHook(cmd, done)
+	}
+}
+
+// killHook escalates a hook that failed to exit in time: SIGTERM first,
+// then SIGKILL after postKillTimeout if it is still running. done is
+// always drained so the process is reaped before killHook returns.
+func killHook(cmd *exec.Cmd, done chan error) error {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		hookLogger().WithError(err).Warn("failed to send SIGTERM to hook")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(postKillTimeout):
+		if err := cmd.Process.Kill(); err != nil {
+			hookLogger().WithError(err).Warn("failed to send SIGKILL to hook")
 		}
+
+		<-done
 	}
 
-	return nil
+	return fmt.Errorf("hook %s timed out or was cancelled", cmd.Path)
 }
 
-func runHooks(ctx context.Context, hooks []specs.Hook, cid, bundlePath, hookType string) error {
+// runHooks runs hooks in order, stopping at (and returning) the first
+// error.
+func runHooks(ctx context.Context, hooks []specs.Hook, state specs.State, hookType string) error {
+	return runHooksWithMode(ctx, hooks, state, hookType, false)
+}
+
+// runHooksBestEffort runs every hook in hooks even if earlier ones fail,
+// so that cleanup hooks releasing host resources (IPs, loop devices, GPU
+// reservations, ...) always get a chance to run. All errors encountered
+// are logged as they happen and returned together as one combined error.
+func runHooksBestEffort(ctx context.Context, hooks []specs.Hook, state specs.State, hookType string) error {
+	return runHooksWithMode(ctx, hooks, state, hookType, true)
+}
+
+func runHooksWithMode(ctx context.Context, hooks []specs.Hook, state specs.State, hookType string, bestEffort bool) error {
 	span, _ := Trace(ctx, "hooks")
 	defer span.Finish()
 
 	span.SetTag("subsystem", hookType)
 
+	var errs multiError
+
 	for _, hook := range hooks {
-		if err := runHook(ctx, hook, cid, bundlePath); err != nil {
+		if err := runHook(ctx, hook, state); err != nil {
 			hookLogger().WithFields(logrus.Fields{
 				"hook-type": hookType,
 				"error":     err,
 			}).Error("hook error")
 
-			return err
+			if !bestEffort {
+				return err
+			}
+
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errs.orNil()
+}
+
+// multiError aggregates the errors returned by running hooks in
+// best-effort mode.
+type multiError []error
+
+func (m multiError) orNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+func (m multiError) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, err := range m {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
 }
 
-// PreStartHooks run the hooks before start container
+// PreStartHooks run the hooks before start container. The container does
+// not exist yet at this point, so its PID is reported as 0, per the OCI
+// spec.
 func PreStartHooks(ctx context.Context, spec oci.CompatOCISpec, cid, bundlePath string) error {
-	// If no hook available, nothing needs to be done.
-	if spec.Hooks == nil {
+	state := newHookState(cid, bundlePath, "creating", 0, spec.Annotations)
+	hooks := mergedHooks(spec, "prestart", inlineHooks(spec, "prestart"))
+
+	// mergedHooks also resolves drop-in hooks, so a missing inline
+	// spec.Hooks is not a reason to skip: a bundle without any "hooks" in
+	// its config.json is exactly the common case the drop-in hook
+	// manager exists for.
+	if len(hooks) == 0 {
 		return nil
 	}
 
-	return runHooks(ctx, spec.Hooks.Prestart, cid, bundlePath, "pre-start")
+	return runHooks(ctx, hooks, state, "pre-start")
 }
 
-// PostStartHooks run the hooks just after start container
-func PostStartHooks(ctx context.Context, spec oci.CompatOCISpec, cid, bundlePath string) error {
-	// If no hook available, nothing needs to be done.
-	if spec.Hooks == nil {
+// PostStartHooks run the hooks just after start container. pid is the
+// container's actual init PID, as reported by the sandbox/agent. The
+// container is already running at this point, so hooks run best-effort:
+// a failing notification hook is not a reason to tear the container back
+// down.
+func PostStartHooks(ctx context.Context, spec oci.CompatOCISpec, cid, bundlePath string, pid int) error {
+	state := newHookState(cid, bundlePath, "running", pid, spec.Annotations)
+	hooks := mergedHooks(spec, "poststart", inlineHooks(spec, "poststart"))
+
+	if len(hooks) == 0 {
 		return nil
 	}
 
-	return runHooks(ctx, spec.Hooks.Poststart, cid, bundlePath, "post-start")
+	return runHooksBestEffort(ctx, hooks, state, "post-start")
 }
 
-// PostStopHooks run the hooks after stop container
-func PostStopHooks(ctx context.Context, spec oci.CompatOCISpec, cid, bundlePath string) error {
-	// If no hook available, nothing needs to be done.
-	if spec.Hooks == nil {
+// PostStopHooks run the hooks after stop container. pid is the
+// container's last known init PID, as reported by the sandbox/agent.
+// Hooks run best-effort: if an early cleanup hook fails, later ones may
+// still need to release host resources (IPs, loop devices, GPU
+// reservations, ...), so they keep running regardless.
+func PostStopHooks(ctx context.Context, spec oci.CompatOCISpec, cid, bundlePath string, pid int) error {
+	state := newHookState(cid, bundlePath, "stopped", pid, spec.Annotations)
+	hooks := mergedHooks(spec, "poststop", inlineHooks(spec, "poststop"))
+
+	if len(hooks) == 0 {
 		return nil
 	}
 
-	return runHooks(ctx, spec.Hooks.Poststop, cid, bundlePath, "post-stop")
+	return runHooksBestEffort(ctx, hooks, state, "post-stop")
+}
+
+// PreCreateHookWhen selects whether a pre-create hook fires. Unlike the
+// drop-in hook definitions used for the other stages, there is no
+// container process or image to match against yet at this point in the
+// lifecycle, so only annotations and the presence of bind mounts can be
+// matched on.
+type PreCreateHookWhen struct {
+	Always        bool              `json:"always,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	HasBindMounts bool              `json:"hasBindMounts,omitempty"`
+}
+
+// PreCreateHook is a hook allowed to rewrite the OCI runtime spec before it
+// is committed to the sandbox. Hooks run in order, each one receiving the
+// (possibly already modified) output of the previous one.
+type PreCreateHook struct {
+	specs.Hook
+	When PreCreateHookWhen `json:"when,omitempty"`
+}
+
+func preCreateHooksFromSpec(spec oci.CompatOCISpec) ([]PreCreateHook, error) {
+	raw, ok := spec.Annotations[preCreateHooksAnnotation]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+
+	var hooks []PreCreateHook
+	if err := json.Unmarshal([]byte(raw), &hooks); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %s", preCreateHooksAnnotation, err)
+	}
+
+	return hooks, nil
+}
+
+func hasBindMounts(spec oci.CompatOCISpec) bool {
+	for _, m := range spec.Mounts {
+		if m.Type == "bind" {
+			return true
+		}
+
+		for _, opt := range m.Options {
+			if opt == "bind" || opt == "rbind" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func preCreateHookShouldRun(hook PreCreateHook, spec oci.CompatOCISpec, hasBindMounts bool) bool {
+	when := hook.When
+
+	if when.Always {
+		return true
+	}
+
+	if when.HasBindMounts && hasBindMounts {
+		return true
+	}
+
+	for key, pattern := range when.Annotations {
+		value, ok := spec.Annotations[key]
+		if !ok {
+			continue
+		}
+
+		if matched, err := regexp.MatchString(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePreCreateSpec rejects pre-create hook changes to fields that
+// would break sandbox setup if altered after the fact.
+func validatePreCreateSpec(old, new oci.CompatOCISpec) error {
+	if old.Root != nil && new.Root != nil && old.Root.Path != new.Root.Path {
+		return fmt.Errorf("pre-create hook is not allowed to change the root path (%q -> %q)", old.Root.Path, new.Root.Path)
+	}
+
+	return nil
+}
+
+// runPreCreateHook runs hook with the current spec marshalled to its
+// stdin, and decodes whatever it writes to stdout as the new spec. A hook
+// that writes nothing to stdout leaves the spec unchanged.
+func runPreCreateHook(ctx context.Context, hook specs.Hook, spec oci.CompatOCISpec) (oci.CompatOCISpec, error) {
+	span, _ := Trace(ctx, "hook")
+	defer span.Finish()
+
+	span.SetTag("subsystem", "runPreCreateHook")
+
+	span.LogFields(
+		log.String("hook-name", hook.Path),
+		log.String("hook-args", strings.Join(hook.Args, " ")))
+
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return spec, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:   hook.Path,
+		Args:   hook.Args,
+		Env:    hook.Env,
+		Stdin:  bytes.NewReader(specJSON),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return spec, err
+	}
+
+	if err := waitHook(ctx, cmd, hook.Timeout); err != nil {
+		return spec, fmt.Errorf("%s: stderr: %s", err, stderr.String())
+	}
+
+	if stdout.Len() == 0 {
+		return spec, nil
+	}
+
+	// Decode onto a deep copy of spec rather than a plain struct copy:
+	// json.Unmarshal reuses existing maps and pointed-to structs, so a
+	// plain copy would let the hook's output modify spec as well.
+	var newSpec oci.CompatOCISpec
+	if err := json.Unmarshal(specJSON, &newSpec); err != nil {
+		return spec, err
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &newSpec); err != nil {
+		return spec, fmt.Errorf("invalid spec returned by pre-create hook %q: %s", hook.Path, err)
+	}
+
+	return newSpec, nil
+}
+
+// PreCreateHooks runs the hooks declared by the pre-create-hooks
+// annotation, feeding each one the current runtime spec and replacing it
+// with whatever the hook writes back, before handing the result to the
+// next hook in the list. This lets trusted hooks rewrite the spec (e.g.
+// injecting devices, mounts, or environment for GPU/vendor libraries)
+// before it is committed to the sandbox, without the caller having to
+// preprocess the bundle. It must be called before CreateSandbox and
+// CreateContainer.
+//
+// NOTE: the create command that should call this (alongside
+// PreStartHooks) lives in the runtime's CLI/create path, which is not
+// part of this change series -- this package only provides the hook
+// primitive. Until that wiring lands, PreCreateHooks has no production
+// caller.
+func PreCreateHooks(ctx context.Context, spec oci.CompatOCISpec, cid, bundlePath string) (oci.CompatOCISpec, error) {
+	span, _ := Trace(ctx, "hooks")
+	defer span.Finish()
+
+	span.SetTag("subsystem", "pre-create")
+
+	hooks, err := preCreateHooksFromSpec(spec)
+	if err != nil {
+		return spec, err
+	}
+
+	bindMounts := hasBindMounts(spec)
+
+	hooks = append(hooks, dropInPreCreateHooks(spec, bindMounts)...)
+
+	if len(hooks) == 0 {
+		return spec, nil
+	}
+
+	for _, hook := range hooks {
+		if !preCreateHookShouldRun(hook, spec, bindMounts) {
+			continue
+		}
+
+		newSpec, err := runPreCreateHook(ctx, hook.Hook, spec)
+		if err != nil {
+			hookLogger().WithFields(logrus.Fields{
+				"hook-type": "pre-create",
+				"error":     err,
+			}).Error("hook error")
+
+			return spec, err
+		}
+
+		if err := validatePreCreateSpec(spec, newSpec); err != nil {
+			return spec, err
+		}
+
+		spec = newSpec
+	}
+
+	return spec, nil
 }
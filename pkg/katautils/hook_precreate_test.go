@@ -0,0 +1,240 @@
+// Copyright (c) 2018 Intel Corporation
+// Copyright (c) 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package katautils
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kata-containers/runtime/pkg/katautils/hooks"
+	"github.com/kata-containers/runtime/virtcontainers/pkg/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeScriptHook writes an executable shell script to dir and returns
+// its path.
+func writeScriptHook(t *testing.T, dir, name, content string) string {
+	script := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(script, []byte(content), 0o755))
+
+	return script
+}
+
+// specWithPreCreateHooks returns a spec whose pre-create-hooks
+// annotation declares hooks.
+func specWithPreCreateHooks(t *testing.T, hooks []PreCreateHook) oci.CompatOCISpec {
+	raw, err := json.Marshal(hooks)
+	assert.NoError(t, err)
+
+	spec := oci.CompatOCISpec{}
+	spec.Annotations = map[string]string{preCreateHooksAnnotation: string(raw)}
+
+	return spec
+}
+
+func TestPreCreateHooksChaining(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "precreate-chain-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	hook1 := writeScriptHook(t, dir, "hook1.sh", "#!/bin/sh\necho '{\"annotations\":{\"step\":\"1\"}}'\n")
+	hook2 := writeScriptHook(t, dir, "hook2.sh",
+		"#!/bin/sh\ninput=$(cat)\n"+
+			"if echo \"$input\" | grep -q '\"step\":\"1\"'; then\n"+
+			"  echo '{\"annotations\":{\"step\":\"1\",\"chained\":\"yes\"}}'\n"+
+			"else\n"+
+			"  echo '{\"annotations\":{\"chained\":\"no\"}}'\n"+
+			"fi\n")
+
+	spec := specWithPreCreateHooks(t, []PreCreateHook{
+		{Hook: specs.Hook{Path: hook1}, When: PreCreateHookWhen{Always: true}},
+		{Hook: specs.Hook{Path: hook2}, When: PreCreateHookWhen{Always: true}},
+	})
+
+	newSpec, err := PreCreateHooks(context.Background(), spec, "cid", dir)
+	assert.NoError(err)
+	assert.Equal("1", newSpec.Annotations["step"])
+	assert.Equal("yes", newSpec.Annotations["chained"], "hook2 should have seen hook1's output on stdin")
+}
+
+func TestPreCreateHooksRejectsRootPathChange(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "precreate-root-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	hook := writeScriptHook(t, dir, "hook.sh", "#!/bin/sh\necho '{\"root\":{\"path\":\"/changed\"}}'\n")
+
+	spec := specWithPreCreateHooks(t, []PreCreateHook{
+		{Hook: specs.Hook{Path: hook}, When: PreCreateHookWhen{Always: true}},
+	})
+	spec.Root = &specs.Root{Path: "/original"}
+
+	newSpec, err := PreCreateHooks(context.Background(), spec, "cid", dir)
+	assert.Error(err)
+	assert.Contains(err.Error(), "root path")
+	assert.Equal("/original", newSpec.Root.Path, "the spec must be left unchanged on rejection")
+}
+
+func TestPreCreateHooksWhenSelectors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "precreate-when-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	markerFile := filepath.Join(dir, "ran")
+	hook := writeScriptHook(t, dir, "hook.sh", "#!/bin/sh\ntouch "+markerFile+"\n")
+
+	tests := []struct {
+		name        string
+		when        PreCreateHookWhen
+		annotations map[string]string
+		mounts      []specs.Mount
+		wantRun     bool
+	}{
+		{name: "always", when: PreCreateHookWhen{Always: true}, wantRun: true},
+		{name: "no selector", when: PreCreateHookWhen{}, wantRun: false},
+		{
+			name:    "has bind mounts, matching",
+			when:    PreCreateHookWhen{HasBindMounts: true},
+			mounts:  []specs.Mount{{Type: "bind"}},
+			wantRun: true,
+		},
+		{
+			name:    "has bind mounts, no bind mounts present",
+			when:    PreCreateHookWhen{HasBindMounts: true},
+			wantRun: false,
+		},
+		{
+			name:        "annotation pattern matches",
+			when:        PreCreateHookWhen{Annotations: map[string]string{"io.katacontainers.gpu": "^nvidia$"}},
+			annotations: map[string]string{"io.katacontainers.gpu": "nvidia"},
+			wantRun:     true,
+		},
+		{
+			name:        "annotation pattern does not match",
+			when:        PreCreateHookWhen{Annotations: map[string]string{"io.katacontainers.gpu": "^nvidia$"}},
+			annotations: map[string]string{"io.katacontainers.gpu": "amd"},
+			wantRun:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			assert.NoError(os.RemoveAll(markerFile))
+
+			spec := specWithPreCreateHooks(t, []PreCreateHook{
+				{Hook: specs.Hook{Path: hook}, When: tt.when},
+			})
+			for k, v := range tt.annotations {
+				spec.Annotations[k] = v
+			}
+			spec.Mounts = tt.mounts
+
+			_, err := PreCreateHooks(context.Background(), spec, "cid", dir)
+			assert.NoError(err)
+
+			_, statErr := os.Stat(markerFile)
+			ran := statErr == nil
+			assert.Equal(tt.wantRun, ran)
+		})
+	}
+}
+
+func TestPreCreateHooksInvalidStdout(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "precreate-invalid-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	hook := writeScriptHook(t, dir, "hook.sh", "#!/bin/sh\necho 'not json'\n")
+
+	spec := specWithPreCreateHooks(t, []PreCreateHook{
+		{Hook: specs.Hook{Path: hook}, When: PreCreateHookWhen{Always: true}},
+	})
+
+	_, err = PreCreateHooks(context.Background(), spec, "cid", dir)
+	assert.Error(err)
+}
+
+func TestPreCreateHooksNoStdoutLeavesSpecUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "precreate-noop-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	hook := writeScriptHook(t, dir, "hook.sh", "#!/bin/sh\nexit 0\n")
+
+	spec := specWithPreCreateHooks(t, []PreCreateHook{
+		{Hook: specs.Hook{Path: hook}, When: PreCreateHookWhen{Always: true}},
+	})
+	spec.Annotations["io.katacontainers.test"] = "unchanged"
+
+	newSpec, err := PreCreateHooks(context.Background(), spec, "cid", dir)
+	assert.NoError(err)
+	assert.Equal("unchanged", newSpec.Annotations["io.katacontainers.test"])
+}
+
+func TestPreCreateHooksDropInMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	hooksDir, err := ioutil.TempDir("", "precreate-dropin-hooks-")
+	assert.NoError(err)
+	defer os.RemoveAll(hooksDir)
+
+	bundleDir, err := ioutil.TempDir("", "precreate-dropin-bundle-")
+	assert.NoError(err)
+	defer os.RemoveAll(bundleDir)
+
+	hook := writeScriptHook(t, bundleDir, "dropin.sh", "#!/bin/sh\necho '{\"annotations\":{\"from\":\"dropin\"}}'\n")
+
+	def := struct {
+		Version string     `json:"version"`
+		Hook    specs.Hook `json:"hook"`
+		When    struct {
+			Always bool `json:"always"`
+		} `json:"when"`
+		Stages []string `json:"stages"`
+	}{
+		Version: "1.0.0",
+		Hook:    specs.Hook{Path: hook},
+		Stages:  []string{"precreate"},
+	}
+	def.When.Always = true
+
+	content, err := json.Marshal(def)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(filepath.Join(hooksDir, "precreate.json"), content, 0o644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := hooks.New(ctx, []string{hooksDir})
+	assert.NoError(err)
+
+	SetHookManager(m)
+	defer SetHookManager(nil)
+
+	// No annotation-declared pre-create hooks: only the drop-in should
+	// fire.
+	spec := oci.CompatOCISpec{}
+
+	newSpec, err := PreCreateHooks(context.Background(), spec, "cid", bundleDir)
+	assert.NoError(err)
+	assert.Equal("dropin", newSpec.Annotations["from"])
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2018 Intel Corporation
+// Copyright (c) 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package katautils
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kata-containers/runtime/pkg/katautils/hooks"
+	"github.com/kata-containers/runtime/virtcontainers/pkg/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCaptureHook writes an executable shell script to dir that copies
+// its stdin to stateFile, then returns the script's path.
+func writeCaptureHook(t *testing.T, dir, stateFile string) string {
+	script := filepath.Join(dir, "capture.sh")
+	content := "#!/bin/sh\ncat > " + stateFile + "\n"
+
+	assert.NoError(t, ioutil.WriteFile(script, []byte(content), 0o755))
+
+	return script
+}
+
+func readCapturedState(t *testing.T, stateFile string) specs.State {
+	data, err := ioutil.ReadFile(stateFile)
+	assert.NoError(t, err)
+
+	var state specs.State
+	assert.NoError(t, json.Unmarshal(data, &state))
+
+	return state
+}
+
+func TestPreStartHooksState(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hook-state-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	hookPath := writeCaptureHook(t, dir, stateFile)
+
+	spec := oci.CompatOCISpec{}
+	spec.Annotations = map[string]string{"io.katacontainers.test": "yes"}
+	spec.Hooks = &specs.Hooks{
+		Prestart: []specs.Hook{{Path: hookPath}},
+	}
+
+	assert.NoError(PreStartHooks(context.Background(), spec, "cid", dir))
+
+	state := readCapturedState(t, stateFile)
+	assert.Equal("cid", state.ID)
+	assert.Equal(dir, state.Bundle)
+	assert.Equal("creating", state.Status)
+	assert.Equal(0, state.Pid)
+	assert.Equal("yes", state.Annotations["io.katacontainers.test"])
+}
+
+func TestPostStartHooksState(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hook-state-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	hookPath := writeCaptureHook(t, dir, stateFile)
+
+	spec := oci.CompatOCISpec{}
+	spec.Hooks = &specs.Hooks{
+		Poststart: []specs.Hook{{Path: hookPath}},
+	}
+
+	assert.NoError(PostStartHooks(context.Background(), spec, "cid", dir, 1234))
+
+	state := readCapturedState(t, stateFile)
+	assert.Equal("running", state.Status)
+	assert.Equal(1234, state.Pid)
+}
+
+func TestPostStopHooksState(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hook-state-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	hookPath := writeCaptureHook(t, dir, stateFile)
+
+	spec := oci.CompatOCISpec{}
+	spec.Hooks = &specs.Hooks{
+		Poststop: []specs.Hook{{Path: hookPath}},
+	}
+
+	assert.NoError(PostStopHooks(context.Background(), spec, "cid", dir, 1234))
+
+	state := readCapturedState(t, stateFile)
+	assert.Equal("stopped", state.Status)
+	assert.Equal(1234, state.Pid)
+}
+
+// writeFailingHook writes an executable shell script to dir that
+// touches markerFile, then exits non-zero with message on stderr.
+func writeFailingHook(t *testing.T, dir, name, markerFile, message string) string {
+	script := filepath.Join(dir, name)
+	content := "#!/bin/sh\ntouch " + markerFile + "\necho " + message + " >&2\nexit 1\n"
+
+	assert.NoError(t, ioutil.WriteFile(script, []byte(content), 0o755))
+
+	return script
+}
+
+// TestPostStopHooksBestEffort verifies that a failing post-stop hook
+// does not stop later hooks from running, and that the returned error
+// aggregates every failure rather than just the first one.
+func TestPostStopHooksBestEffort(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hook-best-effort-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	marker1 := filepath.Join(dir, "ran-1")
+	marker2 := filepath.Join(dir, "ran-2")
+	hook1 := writeFailingHook(t, dir, "hook1.sh", marker1, "hook-1-failed")
+	hook2 := writeFailingHook(t, dir, "hook2.sh", marker2, "hook-2-failed")
+
+	spec := oci.CompatOCISpec{}
+	spec.Hooks = &specs.Hooks{
+		Poststop: []specs.Hook{{Path: hook1}, {Path: hook2}},
+	}
+
+	err = PostStopHooks(context.Background(), spec, "cid", dir, 1234)
+	assert.Error(err)
+	assert.Contains(err.Error(), "hook-1-failed")
+	assert.Contains(err.Error(), "hook-2-failed")
+
+	_, err = os.Stat(marker1)
+	assert.NoError(err, "hook 1 should have run")
+	_, err = os.Stat(marker2)
+	assert.NoError(err, "hook 2 should still have run after hook 1 failed")
+}
+
+// TestPreStartHooksRunsDropInWithNoInlineHooks verifies that a bundle
+// with no "hooks" in its config.json (spec.Hooks == nil) still runs the
+// drop-in hooks discovered by the configured hook manager -- that's the
+// common case the manager exists for.
+func TestPreStartHooksRunsDropInWithNoInlineHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	hooksDir, err := ioutil.TempDir("", "hooks-dropin-")
+	assert.NoError(err)
+	defer os.RemoveAll(hooksDir)
+
+	stateDir, err := ioutil.TempDir("", "hook-state-")
+	assert.NoError(err)
+	defer os.RemoveAll(stateDir)
+
+	stateFile := filepath.Join(stateDir, "state.json")
+	hookPath := writeCaptureHook(t, stateDir, stateFile)
+
+	def := struct {
+		Version string     `json:"version"`
+		Hook    specs.Hook `json:"hook"`
+		When    struct {
+			Always bool `json:"always"`
+		} `json:"when"`
+		Stages []string `json:"stages"`
+	}{
+		Version: "1.0.0",
+		Hook:    specs.Hook{Path: hookPath},
+		Stages:  []string{"prestart"},
+	}
+	def.When.Always = true
+
+	content, err := json.Marshal(def)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(filepath.Join(hooksDir, "precreate.json"), content, 0o644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := hooks.New(ctx, []string{hooksDir})
+	assert.NoError(err)
+
+	SetHookManager(m)
+	defer SetHookManager(nil)
+
+	spec := oci.CompatOCISpec{}
+
+	assert.NoError(PreStartHooks(context.Background(), spec, "cid", stateDir))
+
+	state := readCapturedState(t, stateFile)
+	assert.Equal("cid", state.ID)
+	assert.Equal("creating", state.Status)
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2018 Intel Corporation
+// Copyright (c) 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package hooks
+
+import (
+	"encoding/json"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// hook0_1_0 is the legacy, pre-versioning CRI-O hook definition schema.
+// It predates the "when"/"stages" structure: a hook's annotation
+// patterns are matched against the value of any annotation, whatever its
+// key, and "stage" takes the
+// place of "stages".
+type hook0_1_0 struct {
+	Hook          string   `json:"hook"`
+	Arguments     []string `json:"arguments,omitempty"`
+	Annotations   []string `json:"annotations,omitempty"`
+	HasBindMounts bool     `json:"hasbindmounts,omitempty"`
+	Stage         []string `json:"stage,omitempty"`
+}
+
+// anyAnnotationKey is used as the map key for legacy annotation patterns,
+// which match against the value of any annotation rather than a specific
+// key.
+const anyAnnotationKey = ".*"
+
+func read0_1_0(content []byte) (*Definition, error) {
+	var h hook0_1_0
+	if err := json.Unmarshal(content, &h); err != nil {
+		return nil, err
+	}
+
+	when := When{HasBindMounts: h.HasBindMounts}
+	if len(h.Annotations) > 0 {
+		when.Annotations = map[string][]string{anyAnnotationKey: h.Annotations}
+	}
+
+	return &Definition{
+		Version: "0.1.0",
+		Hook: specs.Hook{
+			Path: h.Hook,
+			Args: append([]string{h.Hook}, h.Arguments...),
+		},
+		When:   when,
+		Stages: h.Stage,
+	}, nil
+}
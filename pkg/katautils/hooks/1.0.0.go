@@ -0,0 +1,35 @@
+// Copyright (c) 2018 Intel Corporation
+// Copyright (c) 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package hooks
+
+import (
+	"encoding/json"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// hook1_0_0 is the current (1.0.0) on-disk hook definition schema.
+type hook1_0_0 struct {
+	Version string     `json:"version"`
+	Hook    specs.Hook `json:"hook"`
+	When    When       `json:"when"`
+	Stages  []string   `json:"stages"`
+}
+
+func read1_0_0(content []byte) (*Definition, error) {
+	var h hook1_0_0
+	if err := json.Unmarshal(content, &h); err != nil {
+		return nil, err
+	}
+
+	return &Definition{
+		Version: "1.0.0",
+		Hook:    h.Hook,
+		When:    h.When,
+		Stages:  h.Stages,
+	}, nil
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2018 Intel Corporation
+// Copyright (c) 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package hooks loads and watches JSON hook-definition drop-in
+// directories (as used by CRI-O and Podman, e.g.
+// /usr/share/containers/oci/hooks.d), and resolves which of the hooks
+// they declare should fire for a given container.
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kata-containers/runtime/virtcontainers/pkg/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+var hooksLogger = logrus.WithField("subsystem", "hooks")
+
+// Manager loads hook definitions from one or more directories and
+// resolves, for a given container, which of them should fire and at
+// which lifecycle stage.
+type Manager struct {
+	sync.RWMutex
+	hooks       map[string]*Definition
+	directories []string
+}
+
+// New creates a Manager, loads every hook definition found under
+// directories, and starts watching them for changes so that hooks added,
+// edited, or removed on disk take effect without a runtime restart.
+func New(ctx context.Context, directories []string) (*Manager, error) {
+	m := &Manager{
+		hooks:       make(map[string]*Definition),
+		directories: directories,
+	}
+
+	for _, dir := range directories {
+		if err := m.loadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating hooks watcher: %v", err)
+	}
+
+	for _, dir := range directories {
+		if err := watcher.Add(dir); err != nil {
+			hooksLogger.WithError(err).Warnf("failed to watch hooks directory %s", dir)
+		}
+	}
+
+	go m.monitor(ctx, watcher)
+
+	return m, nil
+}
+
+// loadDir loads every hook definition found directly under dir. A dir
+// that doesn't exist is not an error: the directories hook drop-ins are
+// conventionally loaded from (e.g. /usr/share/containers/oci/hooks.d)
+// are optional and usually absent unless an operator set one up, so a
+// missing directory is simply skipped rather than failing the whole
+// Manager.
+func (m *Manager) loadDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			hooksLogger.Debugf("hooks directory %s does not exist, skipping", dir)
+			return nil
+		}
+
+		return fmt.Errorf("reading hooks directory %s: %v", dir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		if err := m.loadFile(filepath.Join(dir, entry.Name())); err != nil {
+			hooksLogger.WithError(err).Errorf("failed to load hook %s", entry.Name())
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	def, err := Read(content)
+	if err != nil {
+		return fmt.Errorf("parsing hook %s: %v", path, err)
+	}
+
+	m.Lock()
+	m.hooks[path] = def
+	m.Unlock()
+
+	return nil
+}
+
+func (m *Manager) removeFile(path string) {
+	m.Lock()
+	delete(m.hooks, path)
+	m.Unlock()
+}
+
+func (m *Manager) monitor(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if filepath.Ext(event.Name) != ".json" {
+				continue
+			}
+
+			switch {
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				m.removeFile(event.Name)
+			case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+				if err := m.loadFile(event.Name); err != nil {
+					hooksLogger.WithError(err).Errorf("failed to reload hook %s", event.Name)
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+
+			hooksLogger.WithError(err).Warn("hooks watcher error")
+		}
+	}
+}
+
+// Hooks returns, keyed by lifecycle stage ("prestart", "poststart",
+// "poststop", or Kata's "precreate"), the hooks whose When selector
+// matches spec.
+func (m *Manager) Hooks(spec oci.CompatOCISpec, hasBindMounts bool) (map[string][]specs.Hook, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	stageHooks := make(map[string][]specs.Hook)
+
+	for path, def := range m.hooks {
+		match, err := def.When.Match(spec, hasBindMounts)
+		if err != nil {
+			return nil, fmt.Errorf("matching hook %s: %v", path, err)
+		}
+
+		if !match {
+			continue
+		}
+
+		for _, stage := range def.Stages {
+			stageHooks[stage] = append(stageHooks[stage], def.Hook)
+		}
+	}
+
+	return stageHooks, nil
+}
+
+// Definition is the normalized, in-memory representation of an on-disk
+// hook definition, regardless of which schema version it was decoded
+// from.
+type Definition struct {
+	Version string
+	Hook    specs.Hook
+	When    When
+	Stages  []string
+}
+
+// When selects whether a hook fires for a given container. Annotations
+// maps an annotation key to the regex patterns that key's value may
+// match against; a key may have more than one pattern.
+type When struct {
+	Always        bool                `json:"always,omitempty"`
+	Annotations   map[string][]string `json:"annotations,omitempty"`
+	Commands      []string            `json:"commands,omitempty"`
+	HasBindMounts bool                `json:"hasBindMounts,omitempty"`
+}
+
+// Match reports whether w selects spec, given whether the container has
+// any bind mounts.
+func (w When) Match(spec oci.CompatOCISpec, hasBindMounts bool) (bool, error) {
+	if w.Always {
+		return true, nil
+	}
+
+	if w.HasBindMounts && hasBindMounts {
+		return true, nil
+	}
+
+	for key, patterns := range w.Annotations {
+		values := []string{}
+		if key == anyAnnotationKey {
+			for _, v := range spec.Annotations {
+				values = append(values, v)
+			}
+		} else if value, ok := spec.Annotations[key]; ok {
+			values = append(values, value)
+		}
+
+		for _, pattern := range patterns {
+			for _, value := range values {
+				matched, err := regexp.MatchString(pattern, value)
+				if err != nil {
+					return false, err
+				}
+
+				if matched {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return false, nil
+	}
+
+	command := spec.Process.Args[0]
+	for _, pattern := range w.Commands {
+		matched, err := regexp.MatchString(pattern, command)
+		if err != nil {
+			return false, err
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type versionHeader struct {
+	Version string `json:"version"`
+}
+
+// Read decodes a hook definition file, dispatching on its "version"
+// field. Files written before hooks were versioned (the CRI-O 0.1.0/1
+// schema) have no top-level "version" key.
+func Read(content []byte) (*Definition, error) {
+	var header versionHeader
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, fmt.Errorf("parsing hook version: %v", err)
+	}
+
+	switch strings.TrimSpace(header.Version) {
+	case "":
+		return read0_1_0(content)
+	case "1.0.0":
+		return read1_0_0(content)
+	default:
+		return nil, fmt.Errorf("unsupported hook version %q", header.Version)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2018 Intel Corporation
+// Copyright (c) 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kata-containers/runtime/virtcontainers/pkg/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRead1_0_0(t *testing.T) {
+	assert := assert.New(t)
+
+	content := []byte(`{
+		"version": "1.0.0",
+		"hook": {"path": "/usr/bin/some-hook", "args": ["some-hook"]},
+		"when": {"hasBindMounts": true},
+		"stages": ["prestart", "poststop"]
+	}`)
+
+	def, err := Read(content)
+	assert.NoError(err)
+	assert.Equal("1.0.0", def.Version)
+	assert.Equal("/usr/bin/some-hook", def.Hook.Path)
+	assert.True(def.When.HasBindMounts)
+	assert.Equal([]string{"prestart", "poststop"}, def.Stages)
+}
+
+func TestRead0_1_0(t *testing.T) {
+	assert := assert.New(t)
+
+	// The legacy schema has no "version" field.
+	content := []byte(`{
+		"hook": "/usr/bin/legacy-hook",
+		"arguments": ["--inject"],
+		"annotations": ["^pattern-a$", "^pattern-b$"],
+		"stage": ["prestart"]
+	}`)
+
+	def, err := Read(content)
+	assert.NoError(err)
+	assert.Equal("0.1.0", def.Version)
+	assert.Equal("/usr/bin/legacy-hook", def.Hook.Path)
+	assert.Equal([]string{"/usr/bin/legacy-hook", "--inject"}, def.Hook.Args)
+	assert.Equal([]string{"prestart"}, def.Stages)
+
+	// Both legacy patterns must survive decoding, not just the last one.
+	assert.Equal([]string{"^pattern-a$", "^pattern-b$"}, def.When.Annotations[anyAnnotationKey])
+}
+
+func TestWhenMatchMultipleAnnotationPatterns(t *testing.T) {
+	assert := assert.New(t)
+
+	when := When{
+		Annotations: map[string][]string{
+			anyAnnotationKey: {"^no-match$", "^pattern-b$"},
+		},
+	}
+
+	spec := oci.CompatOCISpec{}
+	spec.Annotations = map[string]string{"io.katacontainers.test": "pattern-b"}
+
+	matched, err := when.Match(spec, false)
+	assert.NoError(err)
+	assert.True(matched, "the second pattern for the key should still be checked")
+}
+
+func TestWhenMatchAlways(t *testing.T) {
+	assert := assert.New(t)
+
+	when := When{Always: true}
+	matched, err := when.Match(oci.CompatOCISpec{}, false)
+	assert.NoError(err)
+	assert.True(matched)
+}
+
+func TestWhenMatchNoSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	matched, err := When{}.Match(oci.CompatOCISpec{}, false)
+	assert.NoError(err)
+	assert.False(matched)
+}
+
+func TestNewSkipsMissingDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hooks-manager-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// /usr/share/containers/oci/hooks.d-style directories are commonly
+	// absent unless an operator configured one: a missing directory must
+	// not stop the other, present directories from loading.
+	missing := filepath.Join(dir, "does-not-exist")
+
+	m, err := New(ctx, []string{missing, dir})
+	assert.NoError(err)
+	assert.NotNil(m)
+}
+
+func writeHookFile(t *testing.T, dir, name string, def hook1_0_0) {
+	content, err := json.Marshal(def)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), content, 0o644))
+}
+
+func TestManagerHooksFromDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hooks-manager-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeHookFile(t, dir, "precreate.json", hook1_0_0{
+		Version: "1.0.0",
+		Hook:    specs.Hook{Path: "/usr/bin/precreate-hook"},
+		When:    When{Always: true},
+		Stages:  []string{"precreate"},
+	})
+	writeHookFile(t, dir, "poststop.json", hook1_0_0{
+		Version: "1.0.0",
+		Hook:    specs.Hook{Path: "/usr/bin/poststop-hook"},
+		When:    When{Annotations: map[string][]string{"io.katacontainers.gpu": {"^nvidia$"}}},
+		Stages:  []string{"poststop"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := New(ctx, []string{dir})
+	assert.NoError(err)
+
+	spec := oci.CompatOCISpec{}
+	spec.Annotations = map[string]string{"io.katacontainers.gpu": "nvidia"}
+
+	stageHooks, err := m.Hooks(spec, false)
+	assert.NoError(err)
+	assert.Len(stageHooks["precreate"], 1)
+	assert.Equal("/usr/bin/precreate-hook", stageHooks["precreate"][0].Path)
+	assert.Len(stageHooks["poststop"], 1)
+	assert.Equal("/usr/bin/poststop-hook", stageHooks["poststop"][0].Path)
+
+	// A container whose annotation doesn't match should not pick up the
+	// poststop hook, but the "always" precreate hook still fires.
+	spec.Annotations = map[string]string{}
+	stageHooks, err = m.Hooks(spec, false)
+	assert.NoError(err)
+	assert.Len(stageHooks["precreate"], 1)
+	assert.Len(stageHooks["poststop"], 0)
+}